@@ -15,6 +15,9 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -23,6 +26,7 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
 	"strings"
 	"text/template"
 )
@@ -38,9 +42,331 @@ type TemplateArgs struct {
 	Warning      string
 	DoltRevision string
 	DepsHash     string
+
+	// DoltInputURL is the flake input URL for the `dolt` input, matching
+	// whatever -source (or the default GitHub archive) was actually
+	// fetched, so the rendered flake builds the same tree DepsHash,
+	// SourceHash, and SourceDirHash were computed against.
+	DoltInputURL string
+
+	// SourceHash is the SHA-256 (hex) of the downloaded source archive, and
+	// SourceDirHash is the Go dirhash-style H1 hash of the extracted source
+	// tree. Both are pinned in SourceHashesFile on the first successful run
+	// for a revision and compared on later runs (SourceHash only when an
+	// archive is actually downloaded), and they are included here as a
+	// second, independent check alongside narHash for downstream Nix
+	// consumers.
+	SourceHash    string
+	SourceDirHash string
+
+	// GoVersion is the major.minor Go version pinned by Dolt's go.mod, e.g.
+	// "1.22", used to select a matching pkgs.go_1_XX toolchain.
+	GoVersion string
+
+	// Targets is the set of GOOS/GOARCH pairs to cross-build release
+	// binaries for, one buildGoModule attribute per entry.
+	Targets []ReleaseTarget
+}
+
+// ReleaseTarget is one GOOS/GOARCH pair to cross-build a release binary
+// for, and the archive extension it should be packaged with.
+type ReleaseTarget struct {
+	GOOS   string
+	GOARCH string
+	Ext    string
+}
+
+// ReleaseTargets are the platforms we cross-build Dolt binaries for.
+var ReleaseTargets = []ReleaseTarget{
+	{GOOS: "linux", GOARCH: "amd64", Ext: "tar.gz"},
+	{GOOS: "linux", GOARCH: "arm64", Ext: "tar.gz"},
+	{GOOS: "darwin", GOARCH: "amd64", Ext: "tar.gz"},
+	{GOOS: "darwin", GOARCH: "arm64", Ext: "tar.gz"},
+	{GOOS: "freebsd", GOARCH: "amd64", Ext: "tar.gz"},
+	{GOOS: "windows", GOARCH: "amd64", Ext: "zip"},
+}
+
+// SourceHashEntry pins the expected hashes for a single Dolt revision, as
+// captured on the first successful run.
+type SourceHashEntry struct {
+	SHA256  string `json:"sha256"`
+	DirHash string `json:"dirHash"`
+}
+
+// SourceHashesFile is a small JSON sidecar, kept alongside flake.lock, that
+// maps a Dolt revision to the hashes we expect DownloadFile and
+// ComputeDirHash to produce for it.
+var SourceHashesFile = "dolt-source-hashes.json"
+
+// LoadSourceHashes reads SourceHashesFile, returning an empty map if it does
+// not yet exist.
+func LoadSourceHashes() (map[string]SourceHashEntry, error) {
+	f, err := os.Open(SourceHashesFile)
+	if os.IsNotExist(err) {
+		return map[string]SourceHashEntry{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not open %s: %w", SourceHashesFile, err)
+	}
+	defer f.Close()
+	entries := make(map[string]SourceHashEntry)
+	err = json.NewDecoder(f).Decode(&entries)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse %s: %w", SourceHashesFile, err)
+	}
+	return entries, nil
+}
+
+// SaveSourceHashes writes entries back to SourceHashesFile.
+func SaveSourceHashes(entries map[string]SourceHashEntry) error {
+	contents, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return fmt.Errorf("could not marshal %s: %w", SourceHashesFile, err)
+	}
+	err = os.WriteFile(SourceHashesFile, append(contents, '\n'), 0644)
+	if err != nil {
+		return fmt.Errorf("could not write %s: %w", SourceHashesFile, err)
+	}
+	return nil
 }
 
 var RevisionSegment = flag.String("revision", "", "a revision path segment for the dolt github flake url; ex: ?ref=tags/v1.20.0, /c3a827c8a8c197402fa955274d667dfecb80e014")
+var WorkDir = flag.String("workdir", "", "a persistent directory to use as the workspace instead of a temporary one; if set, a cached extraction and module download for the resolved revision are reused across runs instead of redone")
+var SourceFlag = flag.String("source", "", "fetch Dolt source from somewhere other than the GitHub archive pinned in flake.lock: git+https://host/repo#ref, file:///path/to/checkout, or a direct https://host/archive.tar.gz URL")
+
+// SourceFetcher populates env.SourceDir with a Dolt source tree. Fetch
+// returns the SHA-256 (hex) of whatever archive it downloaded, or "" if it
+// didn't download one (e.g. a git clone or a local path).
+type SourceFetcher interface {
+	Fetch(env *Environment) (sourceSHA256 string, err error)
+
+	// FlakeInputURL returns the flake input URL for the rendered flake's
+	// `dolt` input, so `nix build` fetches the same source this fetcher
+	// just populated env.SourceDir with, rather than always the upstream
+	// GitHub archive.
+	FlakeInputURL(revSegment string) string
+}
+
+// DefaultDoltInputURL is the flake input URL for the upstream GitHub
+// archive pinned in flake.lock, used whenever -source is not given.
+func DefaultDoltInputURL(revSegment string) string {
+	return "github:dolthub/dolt" + revSegment
+}
+
+// GitHubZipFetcher is the original behavior: download the GitHub archive
+// zip named by env.SourceZipUrl and unzip it in place.
+type GitHubZipFetcher struct{}
+
+func (GitHubZipFetcher) FlakeInputURL(revSegment string) string {
+	return DefaultDoltInputURL(revSegment)
+}
+
+func (GitHubZipFetcher) Fetch(env *Environment) (string, error) {
+	sourceSHA256, err := DownloadFile(env.SourceZip, env.SourceZipUrl)
+	if err != nil {
+		return "", err
+	}
+	cmd := exec.Command(env.UnzipProg, env.SourceZip)
+	cmd.Dir = env.BaseDir
+	err = cmd.Run()
+	if err != nil {
+		return "", fmt.Errorf("could not run unzip on %s: %v", env.SourceZip, err)
+	}
+	return sourceSHA256, nil
+}
+
+// GitFetcher clones a git ref directly into env.SourceDir.
+type GitFetcher struct {
+	URL string
+	Ref string
+}
+
+func (f GitFetcher) FlakeInputURL(string) string {
+	if f.Ref == "HEAD" {
+		return "git+" + f.URL
+	}
+	key := "ref"
+	if isGitSHA(f.Ref) {
+		key = "rev"
+	}
+	sep := "?"
+	if strings.Contains(f.URL, "?") {
+		sep = "&"
+	}
+	return "git+" + f.URL + sep + key + "=" + f.Ref
+}
+
+func (f GitFetcher) Fetch(env *Environment) (string, error) {
+	gitprog, err := exec.LookPath("git")
+	if err != nil {
+		return "", fmt.Errorf("did not find required executable, git, in PATH: %w", err)
+	}
+	// `git clone --branch` only accepts a branch or tag name: it rejects a
+	// commit SHA, and there is no "HEAD" branch to request either. Those two
+	// ref kinds need a full clone followed by an explicit checkout instead
+	// of the shallow, ref-restricted clone we can use for an actual
+	// branch/tag.
+	if f.Ref == "HEAD" || isGitSHA(f.Ref) {
+		cmd := exec.Command(gitprog, "clone", f.URL, env.SourceDir)
+		err = cmd.Run()
+		if err != nil {
+			return "", fmt.Errorf("could not `git clone %s %s`: %w", f.URL, env.SourceDir, err)
+		}
+		if f.Ref != "HEAD" {
+			cmd = exec.Command(gitprog, "checkout", f.Ref)
+			cmd.Dir = env.SourceDir
+			err = cmd.Run()
+			if err != nil {
+				return "", fmt.Errorf("could not `git checkout %s` in %s: %w", f.Ref, env.SourceDir, err)
+			}
+		}
+		return "", nil
+	}
+	cmd := exec.Command(gitprog, "clone", "--depth=1", "--branch", f.Ref, f.URL, env.SourceDir)
+	err = cmd.Run()
+	if err != nil {
+		return "", fmt.Errorf("could not `git clone --depth=1 --branch %s %s`: %w", f.Ref, f.URL, err)
+	}
+	return "", nil
+}
+
+// isGitSHA reports whether ref looks like a git commit SHA (full or
+// abbreviated hex), as opposed to a branch or tag name.
+func isGitSHA(ref string) bool {
+	if len(ref) < 7 || len(ref) > 40 {
+		return false
+	}
+	for _, r := range ref {
+		if !strings.ContainsRune("0123456789abcdef", r) {
+			return false
+		}
+	}
+	return true
+}
+
+// LocalPathFetcher symlinks an existing checkout into env.SourceDir without
+// downloading anything, for hashing a work-in-progress Dolt fork.
+type LocalPathFetcher struct {
+	Path string
+}
+
+func (f LocalPathFetcher) FlakeInputURL(string) string {
+	abs, err := filepath.Abs(f.Path)
+	if err != nil {
+		abs = f.Path
+	}
+	return "path:" + abs
+}
+
+func (f LocalPathFetcher) Fetch(env *Environment) (string, error) {
+	err := os.Symlink(f.Path, env.SourceDir)
+	if err != nil {
+		return "", fmt.Errorf("could not symlink %s to %s: %w", f.Path, env.SourceDir, err)
+	}
+	return "", nil
+}
+
+// URLArchiveFetcher downloads an arbitrary .tar.gz/.tgz/.zip URL and
+// extracts its single top-level directory into env.SourceDir.
+type URLArchiveFetcher struct {
+	URL string
+}
+
+func (f URLArchiveFetcher) FlakeInputURL(string) string {
+	return f.URL
+}
+
+func (f URLArchiveFetcher) Fetch(env *Environment) (string, error) {
+	extractDir, err := os.MkdirTemp(env.BaseDir, "url-source-*")
+	if err != nil {
+		return "", fmt.Errorf("could not create temporary extraction dir: %w", err)
+	}
+	filename := filepath.Base(f.URL)
+	dest := filepath.Join(env.BaseDir, filename)
+	sourceSHA256, err := DownloadFile(dest, f.URL)
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case strings.HasSuffix(filename, ".tar.gz"), strings.HasSuffix(filename, ".tgz"):
+		tarprog, err := exec.LookPath("tar")
+		if err != nil {
+			return "", fmt.Errorf("did not find required executable, tar, in PATH: %w", err)
+		}
+		err = exec.Command(tarprog, "xzf", dest, "-C", extractDir).Run()
+		if err != nil {
+			return "", fmt.Errorf("could not extract %s: %w", dest, err)
+		}
+	case strings.HasSuffix(filename, ".zip"):
+		cmd := exec.Command(env.UnzipProg, dest)
+		cmd.Dir = extractDir
+		err = cmd.Run()
+		if err != nil {
+			return "", fmt.Errorf("could not extract %s: %w", dest, err)
+		}
+	default:
+		return "", fmt.Errorf("could not determine archive type of %s: expected a .tar.gz, .tgz, or .zip suffix", f.URL)
+	}
+	entries, err := os.ReadDir(extractDir)
+	if err != nil {
+		return "", fmt.Errorf("could not read extracted contents of %s: %w", dest, err)
+	}
+	if len(entries) != 1 || !entries[0].IsDir() {
+		return "", fmt.Errorf("expected %s to extract to a single top-level directory", f.URL)
+	}
+	err = os.Rename(filepath.Join(extractDir, entries[0].Name()), env.SourceDir)
+	if err != nil {
+		return "", fmt.Errorf("could not move extracted %s into place at %s: %w", entries[0].Name(), env.SourceDir, err)
+	}
+	return sourceSHA256, nil
+}
+
+// sourceIdentityTag returns a short, stable hash of identifier suitable for
+// keying a cache/workspace directory and SourceHashesFile entry. Using a
+// fixed placeholder instead (e.g. always "local" for every file:// source)
+// would make two different sources collide on the same cache slot.
+func sourceIdentityTag(identifier string) string {
+	sum := sha256.Sum256([]byte(identifier))
+	return hex.EncodeToString(sum[:8])
+}
+
+// ParseSource parses the -source flag into a SourceFetcher plus a revision
+// string to key the workspace and rendered flake by, dispatching on URL
+// scheme the way HashiCorp's go-getter does. An empty source reports a nil
+// fetcher, telling the caller to fall back to the GitHub archive pinned in
+// flake.lock.
+func ParseSource(source string) (fetcher SourceFetcher, revision string, err error) {
+	switch {
+	case source == "":
+		return nil, "", nil
+	case strings.HasPrefix(source, "git+"):
+		rest := strings.TrimPrefix(source, "git+")
+		url, ref := rest, "HEAD"
+		if i := strings.LastIndex(rest, "#"); i >= 0 {
+			url, ref = rest[:i], rest[i+1:]
+		}
+		revision := ref + "-" + sourceIdentityTag(url+"#"+ref)
+		return GitFetcher{URL: url, Ref: ref}, revision, nil
+	case strings.HasPrefix(source, "file://"):
+		path := strings.TrimPrefix(source, "file://")
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return nil, "", fmt.Errorf("could not resolve absolute path of -source %q: %w", source, err)
+		}
+		return LocalPathFetcher{Path: path}, "local-" + sourceIdentityTag(abs), nil
+	case strings.HasPrefix(source, "http://"), strings.HasPrefix(source, "https://"):
+		name := filepath.Base(source)
+		for _, ext := range []string{".tar.gz", ".tgz", ".zip"} {
+			if strings.HasSuffix(name, ext) {
+				stem := strings.TrimSuffix(name, ext)
+				return URLArchiveFetcher{URL: source}, stem + "-" + sourceIdentityTag(source), nil
+			}
+		}
+		return nil, "", fmt.Errorf("could not determine archive type of -source %q: expected a .tar.gz, .tgz, or .zip suffix", source)
+	default:
+		return nil, "", fmt.Errorf("could not parse -source %q: expected a git+, file://, or http(s):// URL", source)
+	}
+}
 
 // This is our workspace where we will create file trees, hash them, etc.
 // Be sure to clean it up with `env.Close`
@@ -52,12 +378,23 @@ type Environment struct {
 
 	BaseDir string
 
+	// Ephemeral is true when BaseDir was created with os.MkdirTemp and
+	// should be wiped by Close; it is false when BaseDir is a persistent
+	// -workdir that the caller is responsible for.
+	Ephemeral bool
+
 	SourceZipUrl string
 	SourceZip    string
 
 	// Extracted source code.
 	SourceDir string
 
+	// PartialMarker is written before extraction begins and only removed
+	// once extraction and `go mod download` have both succeeded, so a run
+	// interrupted partway through never leaves a seemingly-complete
+	// SourceDir behind.
+	PartialMarker string
+
 	GoModuleDir string
 	GoCacheDir  string
 	GoPathDir   string
@@ -67,10 +404,12 @@ type Environment struct {
 }
 
 func (e *Environment) Close() {
-	os.RemoveAll(e.BaseDir)
+	if e.Ephemeral {
+		os.RemoveAll(e.BaseDir)
+	}
 }
 
-func NewEnvironment(nixprog, revision string) (*Environment, error) {
+func NewEnvironment(nixprog, revision, workdir string) (*Environment, error) {
 	goprog, err := exec.LookPath("go")
 	if err != nil {
 		return nil, fmt.Errorf("did not find required executable, go, in PATH: %w", err)
@@ -79,9 +418,20 @@ func NewEnvironment(nixprog, revision string) (*Environment, error) {
 	if err != nil {
 		return nil, fmt.Errorf("did not find required executable, unzip, in PATH: %w", err)
 	}
-	dir, err := os.MkdirTemp("", "dolt-nix-flake-*")
-	if err != nil {
-		return nil, fmt.Errorf("could not create temp dir: %w", err)
+
+	var dir string
+	ephemeral := workdir == ""
+	if ephemeral {
+		dir, err = os.MkdirTemp("", "dolt-nix-flake-*")
+		if err != nil {
+			return nil, fmt.Errorf("could not create temp dir: %w", err)
+		}
+	} else {
+		dir = workdir
+		err = os.MkdirAll(dir, 0777)
+		if err != nil {
+			return nil, fmt.Errorf("could not create workdir %v: %w", dir, err)
+		}
 	}
 
 	filename := fmt.Sprintf(FilePattern, revision)
@@ -92,9 +442,11 @@ func NewEnvironment(nixprog, revision string) (*Environment, error) {
 	env.GoProg = goprog
 	env.UnzipProg = unzipprog
 	env.BaseDir = dir
+	env.Ephemeral = ephemeral
 	env.SourceZipUrl = DownloadPath + filename
 	env.SourceZip = filepath.Join(env.BaseDir, filename)
 	env.SourceDir = filepath.Join(env.BaseDir, extracteddir)
+	env.PartialMarker = env.SourceDir + ".partial"
 	env.GoModuleDir = filepath.Join(env.SourceDir, "go")
 	env.GoCacheDir = filepath.Join(env.BaseDir, "go-cache")
 	env.GoPathDir = filepath.Join(env.BaseDir, "go")
@@ -113,6 +465,58 @@ func NewEnvironment(nixprog, revision string) (*Environment, error) {
 	return env, nil
 }
 
+// ParseGoModVersion reads the `go X.Y` (or `go X.Y.Z`) directive out of the
+// given go.mod file and returns just the major.minor component, e.g. "1.22".
+func ParseGoModVersion(goModPath string) (string, error) {
+	contents, err := os.ReadFile(goModPath)
+	if err != nil {
+		return "", fmt.Errorf("could not read %s: %w", goModPath, err)
+	}
+	for _, line := range strings.Split(string(contents), "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "go ") {
+			continue
+		}
+		version := strings.TrimSpace(strings.TrimPrefix(line, "go "))
+		parts := strings.SplitN(version, ".", 3)
+		if len(parts) < 2 {
+			return "", fmt.Errorf("could not parse go directive %q in %s", line, goModPath)
+		}
+		return parts[0] + "." + parts[1], nil
+	}
+	return "", fmt.Errorf("no `go` directive found in %s", goModPath)
+}
+
+// NixGoAttr returns the nixpkgs attribute name for the given major.minor Go
+// version, e.g. "1.22" -> "go_1_22".
+func NixGoAttr(goVersion string) string {
+	return "go_" + strings.ReplaceAll(goVersion, ".", "_")
+}
+
+// ResolveGoProg finds a hermetic Go toolchain matching goVersion by building
+// the corresponding nixpkgs attribute out of the Nix store, so vendorHash
+// computation is reproducible across developer machines regardless of the
+// ambient Go install. It falls back to the ambient PATH `go`, with a
+// warning, if the pinned version cannot be resolved.
+func ResolveGoProg(nixprog, goVersion string) string {
+	attr := NixGoAttr(goVersion)
+	cmd := exec.Command(nixprog, "build", "--no-link", "--print-out-paths", "nixpkgs#"+attr)
+	out, err := cmd.Output()
+	if err == nil {
+		storePath := strings.TrimSpace(strings.SplitN(string(out), "\n", 2)[0])
+		goBin := filepath.Join(storePath, "bin", "go")
+		if _, statErr := os.Stat(goBin); statErr == nil {
+			return goBin
+		}
+	}
+	fmt.Fprintf(os.Stderr, "warning: could not resolve hermetic Go %s via nixpkgs#%s, falling back to `go` on PATH: %v\n", goVersion, attr, err)
+	goprog, err := exec.LookPath("go")
+	if err != nil {
+		panic(fmt.Errorf("did not find required executable, go, in PATH: %w", err))
+	}
+	return goprog
+}
+
 func main() {
 	flag.Parse()
 
@@ -121,44 +525,119 @@ func main() {
 		panic(fmt.Errorf("did not find required executable, nix-hash, in PATH: %v", err))
 	}
 
-	err = WriteFlake(*RevisionSegment, FakeNarHash)
+	fetcher, revHash, err := ParseSource(*SourceFlag)
 	if err != nil {
 		panic(err)
 	}
 
-	err = NixFlakeUpdate(nixprog)
-	if err != nil {
-		panic(err)
+	if fetcher == nil {
+		err = WriteFlake(*RevisionSegment, FakeNarHash, "", "", "", DefaultDoltInputURL(*RevisionSegment))
+		if err != nil {
+			panic(err)
+		}
+
+		err = NixFlakeUpdate(nixprog)
+		if err != nil {
+			panic(err)
+		}
+
+		// Now flake.lock is updated. Read the dolt rev and calculate our venderHash from it.
+		revHash, err = ReadLockContents()
+		if err != nil {
+			panic(err)
+		}
+
+		fetcher = GitHubZipFetcher{}
 	}
 
-	// Now flake.lock is updated. Read the dolt rev and calculate our venderHash from it.
-	revHash, err := ReadLockContents()
+	env, err := NewEnvironment(nixprog, revHash, *WorkDir)
 	if err != nil {
 		panic(err)
 	}
+	defer env.Close()
 
-	env, err := NewEnvironment(nixprog, revHash)
+	sourceHashes, err := LoadSourceHashes()
 	if err != nil {
 		panic(err)
 	}
-	defer env.Close()
-
-	// Download the zip file of the source code.
-	err = DownloadFile(env.SourceZip, env.SourceZipUrl)
-
-	// Extract it.
-	cmd := exec.Command(env.UnzipProg, env.SourceZip)
-	cmd.Dir = env.BaseDir
-	err = cmd.Run()
+	pinned, alreadyPinned := sourceHashes[revHash]
+
+	extractedDirInfo, statErr := os.Stat(env.SourceDir)
+	extractionCached := statErr == nil && extractedDirInfo.IsDir()
+	if _, err := os.Stat(env.PartialMarker); extractionCached && err == nil {
+		// A previous run was interrupted partway through extraction; the
+		// cache can't be trusted, so wipe it and start over.
+		err = os.RemoveAll(env.SourceDir)
+		if err != nil {
+			panic(fmt.Errorf("could not remove partially-extracted %s: %w", env.SourceDir, err))
+		}
+		extractionCached = false
+	}
+
+	var sourceSHA256, sourceDirHash string
+	if extractionCached {
+		sourceSHA256 = pinned.SHA256
+		sourceDirHash, err = ComputeDirHash(env.SourceDir)
+		if err != nil {
+			panic(fmt.Errorf("could not compute dirhash of %s: %w", env.SourceDir, err))
+		}
+		if alreadyPinned && pinned.DirHash != sourceDirHash {
+			panic(fmt.Errorf("cached extraction at %s has dirhash %s, but %s pins %s for revision %s -- remove %s and re-run", env.SourceDir, sourceDirHash, SourceHashesFile, pinned.DirHash, revHash, env.SourceDir))
+		}
+	} else {
+		err = os.WriteFile(env.PartialMarker, []byte(revHash+"\n"), 0644)
+		if err != nil {
+			panic(fmt.Errorf("could not write partial marker %s: %w", env.PartialMarker, err))
+		}
+
+		sourceSHA256, err = fetcher.Fetch(env)
+		if err != nil {
+			panic(err)
+		}
+		if alreadyPinned && sourceSHA256 != "" && pinned.SHA256 != sourceSHA256 {
+			panic(fmt.Errorf("fetched source has sha256 %s, but %s pins %s for revision %s -- possible corrupted download or MITM", sourceSHA256, SourceHashesFile, pinned.SHA256, revHash))
+		}
+
+		sourceDirHash, err = ComputeDirHash(env.SourceDir)
+		if err != nil {
+			panic(fmt.Errorf("could not compute dirhash of %s: %w", env.SourceDir, err))
+		}
+		if alreadyPinned && pinned.DirHash != sourceDirHash {
+			panic(fmt.Errorf("extracted source tree %s has dirhash %s, but %s pins %s for revision %s -- possible corrupted download or MITM", env.SourceDir, sourceDirHash, SourceHashesFile, pinned.DirHash, revHash))
+		}
+	}
+
+	goVersion, err := ParseGoModVersion(filepath.Join(env.GoModuleDir, "go.mod"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "warning: could not determine pinned Go version: %v; using `go` on PATH\n", err)
+	} else {
+		env.GoProg = ResolveGoProg(env.NixProg, goVersion)
+	}
+
+	// Download the dependencies into a fresh GOPATH, seeded from the
+	// previous run's download cache (if any) so an unchanged go.mod/go.sum
+	// does not re-fetch every dependency over the network on a persistent
+	// -workdir, then atomically swap the result into env.GoDownloadPath so
+	// a second invocation racing on the same revision can never observe a
+	// half-populated download cache.
+	tmpGoPathDir, err := os.MkdirTemp(env.GoPathDir, "download-*")
 	if err != nil {
-		panic(fmt.Errorf("could not run unzip on %s: %v", env.SourceZip, err))
+		panic(fmt.Errorf("could not create temporary GOPATH directory under %s: %w", env.GoPathDir, err))
 	}
+	defer os.RemoveAll(tmpGoPathDir)
 
-	// Download the dependencies.
-	cmd = exec.Command(env.GoProg, "mod", "download")
+	tmpDownloadPath := filepath.Join(tmpGoPathDir, "pkg", "mod", "cache", "download")
+	if previousDownloadPath, err := filepath.EvalSymlinks(env.GoDownloadPath); err == nil {
+		err = seedDownloadCache(previousDownloadPath, tmpDownloadPath)
+		if err != nil {
+			panic(fmt.Errorf("could not seed download cache from %s: %w", previousDownloadPath, err))
+		}
+	}
+
+	cmd := exec.Command(env.GoProg, "mod", "download")
 	cmd.Dir = env.GoModuleDir
 	cmd.Env = append(cmd.Env, "GOCACHE="+env.GoCacheDir)
-	cmd.Env = append(cmd.Env, "GOPATH="+env.GoPathDir)
+	cmd.Env = append(cmd.Env, "GOPATH="+tmpGoPathDir)
 	err = cmd.Run()
 	if err != nil {
 		panic(fmt.Errorf("could not run `go mod download` in %s: %v", cmd.Dir, err))
@@ -166,42 +645,273 @@ func main() {
 
 	// Cleanup sumdb, which does not go in the derivation and should not
 	// contribute to the vendorHash.
-	err = os.RemoveAll(env.GoDownloadSumDBPath)
+	err = os.RemoveAll(filepath.Join(tmpDownloadPath, "sumdb"))
 	if err != nil {
-		panic(fmt.Errorf("could not remote sumdb path at %s: %w", env.GoDownloadSumDBPath, err))
+		panic(fmt.Errorf("could not remote sumdb path under %s: %w", tmpDownloadPath, err))
 	}
 
-	modhash, err := NixHashDir(env.NixProg, env.GoDownloadPath)
+	// Move the freshly populated download cache out from under tmpGoPathDir
+	// (which the defer above will remove) and into a location of its own
+	// under env.GoPathDir, so it survives independently of this run's temp
+	// GOPATH.
+	permanentDownloadPath, err := os.MkdirTemp(env.GoPathDir, "download-cache-*")
+	if err != nil {
+		panic(fmt.Errorf("could not reserve a permanent download cache path under %s: %w", env.GoPathDir, err))
+	}
+	err = os.Remove(permanentDownloadPath)
+	if err != nil {
+		panic(fmt.Errorf("could not free reserved path %s: %w", permanentDownloadPath, err))
+	}
+	err = os.Rename(tmpDownloadPath, permanentDownloadPath)
+	if err != nil {
+		panic(fmt.Errorf("could not move %s to %s: %w", tmpDownloadPath, permanentDownloadPath, err))
+	}
+
+	// Point env.GoDownloadPath at the new cache by swapping a symlink into
+	// place with a single os.Rename, rather than os.RemoveAll followed by
+	// os.Rename: that left a window where a second invocation racing on the
+	// same revision could observe env.GoDownloadPath missing entirely.
+	// Renaming a symlink onto env.GoDownloadPath's path is a single atomic
+	// directory-entry swap, so readers always see either the old or the
+	// new cache, never neither.
+	err = os.MkdirAll(filepath.Dir(env.GoDownloadPath), 0777)
+	if err != nil {
+		panic(fmt.Errorf("could not create %s: %w", filepath.Dir(env.GoDownloadPath), err))
+	}
+	previousDownloadPath, _ := os.Readlink(env.GoDownloadPath)
+
+	newLink, err := os.MkdirTemp(filepath.Dir(env.GoDownloadPath), "download-link-*")
+	if err != nil {
+		panic(fmt.Errorf("could not reserve a symlink path under %s: %w", filepath.Dir(env.GoDownloadPath), err))
+	}
+	err = os.Remove(newLink)
+	if err != nil {
+		panic(fmt.Errorf("could not free reserved path %s: %w", newLink, err))
+	}
+	err = os.Symlink(permanentDownloadPath, newLink)
+	if err != nil {
+		panic(fmt.Errorf("could not symlink %s to %s: %w", newLink, permanentDownloadPath, err))
+	}
+	err = os.Rename(newLink, env.GoDownloadPath)
+	if err != nil {
+		panic(fmt.Errorf("could not move %s into place at %s: %w", newLink, env.GoDownloadPath, err))
+	}
+	if previousDownloadPath != "" {
+		os.RemoveAll(previousDownloadPath)
+	}
+
+	caseSafeDownloadPath, err := CaseSafeModuleCache(env.GoDownloadPath)
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(caseSafeDownloadPath)
+
+	modhash, err := NixHashDir(env.NixProg, caseSafeDownloadPath)
 	if err != nil {
 		panic(fmt.Errorf("could not nix-hash the download go module dependencies at %s: %w", env.GoDownloadPath, err))
 	}
 
-	err = WriteFlake(*RevisionSegment, modhash)
+	// Extraction and the module download both succeeded: the cache is
+	// trustworthy, so drop the partial marker and pin the hashes we saw.
+	err = os.Remove(env.PartialMarker)
+	if err != nil && !os.IsNotExist(err) {
+		panic(fmt.Errorf("could not remove partial marker %s: %w", env.PartialMarker, err))
+	}
+	sourceHashes[revHash] = SourceHashEntry{SHA256: sourceSHA256, DirHash: sourceDirHash}
+	err = SaveSourceHashes(sourceHashes)
+	if err != nil {
+		panic(err)
+	}
+
+	err = WriteFlake(*RevisionSegment, modhash, sourceSHA256, sourceDirHash, goVersion, fetcher.FlakeInputURL(*RevisionSegment))
 	if err != nil {
 		panic(err)
 	}
 }
 
-// Downloads the given URL to the given destination filename. The directory for
-// the given filename must already exist and the file itself must not.
-func DownloadFile(dest, url string) error {
+// Downloads the given URL to the given destination filename, returning the
+// hex-encoded SHA-256 of the downloaded bytes. The directory for the given
+// filename must already exist and the file itself must not.
+func DownloadFile(dest, url string) (string, error) {
 	dlf, err := os.Create(dest)
 	if err != nil {
-		return fmt.Errorf("DownloadFile: error creating file %s: %w", dest, err)
+		return "", fmt.Errorf("DownloadFile: error creating file %s: %w", dest, err)
 	}
 	defer dlf.Close()
 	resp, err := http.Get(url)
 	if err != nil {
-		return fmt.Errorf("DownloadFile: error GETing %s: %w", url, err)
+		return "", fmt.Errorf("DownloadFile: error GETing %s: %w", url, err)
 	}
+	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("could not fetch %s, got status code: %d", url, resp.StatusCode)
+		return "", fmt.Errorf("could not fetch %s, got status code: %d", url, resp.StatusCode)
 	}
-	_, err = io.Copy(dlf, resp.Body)
+	hasher := sha256.New()
+	_, err = io.Copy(io.MultiWriter(dlf, hasher), resp.Body)
 	if err != nil {
-		return fmt.Errorf("could not download entire file: %w", err)
+		return "", fmt.Errorf("could not download entire file: %w", err)
 	}
-	return nil
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// ComputeDirHash computes the Go dirhash "h1:" checksum of the given
+// directory tree: every regular file under dir is hashed, sorted by its
+// slash-separated relative path, and a final hash is taken over the lines
+// "<sha256 of file>  <relative path>\n" -- the same algorithm
+// cmd/go/internal/modfetch uses to hash module zips.
+func ComputeDirHash(dir string) (string, error) {
+	// dir may itself be a symlink (LocalPathFetcher points env.SourceDir at
+	// a fork checkout this way), and filepath.Walk does not follow a
+	// symlink root -- it just reports the link as a non-directory and never
+	// recurses -- so resolve it first, as CaseSafeModuleCache already does.
+	resolved, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return "", fmt.Errorf("could not resolve %s: %w", dir, err)
+	}
+	var files []string
+	err = filepath.Walk(resolved, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			rel, err := filepath.Rel(resolved, path)
+			if err != nil {
+				return err
+			}
+			files = append(files, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("could not walk %s: %w", dir, err)
+	}
+	sort.Strings(files)
+
+	h := sha256.New()
+	for _, f := range files {
+		fh := sha256.New()
+		file, err := os.Open(filepath.Join(resolved, f))
+		if err != nil {
+			return "", fmt.Errorf("could not open %s: %w", f, err)
+		}
+		_, err = io.Copy(fh, file)
+		file.Close()
+		if err != nil {
+			return "", fmt.Errorf("could not hash %s: %w", f, err)
+		}
+		fmt.Fprintf(h, "%x  %s\n", fh.Sum(nil), f)
+	}
+	return "h1:" + base64.StdEncoding.EncodeToString(h.Sum(nil)), nil
+}
+
+// EscapeModulePathSegment rewrites a single path segment using Go's module
+// cache "safe encoding" (cmd/go/internal/module.EscapePath): each uppercase
+// letter X becomes "!x".
+func EscapeModulePathSegment(segment string) string {
+	var b strings.Builder
+	for _, r := range segment {
+		if r >= 'A' && r <= 'Z' {
+			b.WriteByte('!')
+			b.WriteRune(r - 'A' + 'a')
+		} else {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// CaseSafeModuleCache copies dir into a new temporary directory with every
+// path segment run through EscapeModulePathSegment, so that hashing the
+// result gives the same answer regardless of whether the module cache was
+// populated on a case-sensitive or a case-insensitive filesystem (e.g.
+// macOS's default APFS). Without this, modules whose paths differ only in
+// case, like github.com/Sirupsen/logrus vs github.com/sirupsen/logrus,
+// collide on a case-insensitive filesystem and silently produce a wrong
+// vendorHash that fails on Linux builders. The caller is responsible for
+// removing the returned directory.
+func CaseSafeModuleCache(dir string) (string, error) {
+	// env.GoDownloadPath is swapped into place with a symlink (see the
+	// atomic rename in main), and filepath.Walk does not follow a symlink
+	// root, so resolve it to the real directory first.
+	resolved, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return "", fmt.Errorf("could not resolve %s: %w", dir, err)
+	}
+	dest, err := os.MkdirTemp(filepath.Dir(resolved), "case-safe-*")
+	if err != nil {
+		return "", fmt.Errorf("could not create case-safe copy dir: %w", err)
+	}
+	err = filepath.Walk(resolved, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(resolved, path)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		segments := strings.Split(filepath.ToSlash(rel), "/")
+		for i, s := range segments {
+			segments[i] = EscapeModulePathSegment(s)
+		}
+		target := filepath.Join(append([]string{dest}, segments...)...)
+		if info.IsDir() {
+			return os.MkdirAll(target, 0777)
+		}
+		return copyFileMode(path, target, info.Mode())
+	})
+	if err != nil {
+		os.RemoveAll(dest)
+		return "", fmt.Errorf("could not build case-safe copy of %s: %w", dir, err)
+	}
+	return dest, nil
+}
+
+// seedDownloadCache recursively hardlinks every file under src into dst, so
+// a fresh `go mod download` GOPATH starts out with the same contents as a
+// previous run's download cache instead of a truly empty one, letting `go
+// mod download` skip the network fetch for any module it already has.
+// Hardlinking avoids both the cost of copying the bytes and any risk of
+// mutating src: any new module `go mod download` writes into dst lands as a
+// new directory entry there, never in src, so a concurrent reader of src
+// (e.g. another invocation still using the cache dst was seeded from) is
+// never affected.
+func seedDownloadCache(src, dst string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if info.IsDir() {
+			return os.MkdirAll(target, 0777)
+		}
+		return os.Link(path, target)
+	})
+}
+
+func copyFileMode(src, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	err = os.MkdirAll(filepath.Dir(dst), 0777)
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	_, err = io.Copy(out, in)
+	return err
 }
 
 // Run `nix hash path --base64 --type sha256 $dir` and return the hash for the contents of the directory.
@@ -255,7 +965,7 @@ func ReadLockContents() (string, error) {
 	return unmarshalled.Node.Dolt.Lock.Rev, nil
 }
 
-func WriteFlake(revSegment, depsHash string) error {
+func WriteFlake(revSegment, depsHash, sourceHash, sourceDirHash, goVersion, doltInputURL string) error {
 	tmpl, err := template.ParseFiles("flake.nix.template")
 	if err != nil {
 		panic(fmt.Errorf("could not load the nix flake template: %w", err))
@@ -270,9 +980,14 @@ func WriteFlake(revSegment, depsHash string) error {
 	}
 	defer os.Remove(t.Name())
 	err = tmpl.ExecuteTemplate(t, "flake.nix.template", TemplateArgs{
-		Warning:      GeneratedFileWarning,
-		DoltRevision: revSegment,
-		DepsHash:     depsHash,
+		Warning:       GeneratedFileWarning,
+		DoltRevision:  revSegment,
+		DepsHash:      depsHash,
+		DoltInputURL:  doltInputURL,
+		SourceHash:    sourceHash,
+		SourceDirHash: sourceDirHash,
+		GoVersion:     goVersion,
+		Targets:       ReleaseTargets,
 	})
 	t.Close()
 	if err != nil {
@@ -0,0 +1,91 @@
+// Copyright 2023 Dolthub, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEscapeModulePathSegment(t *testing.T) {
+	cases := map[string]string{
+		"sirupsen": "sirupsen",
+		"Sirupsen": "!sirupsen",
+		"FooBar":   "!foo!bar",
+	}
+	for in, want := range cases {
+		if got := EscapeModulePathSegment(in); got != want {
+			t.Errorf("EscapeModulePathSegment(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+// TestCaseSafeModuleCacheMatchesLinuxLayout seeds a fake cache with two
+// module paths that differ only in case -- something only a case-sensitive
+// filesystem like a Linux builder can hold side by side -- and asserts that
+// escaping it with CaseSafeModuleCache produces the same dirhash as the
+// "!x"-encoded layout a Linux Go toolchain already uses on disk.
+func TestCaseSafeModuleCacheMatchesLinuxLayout(t *testing.T) {
+	src := t.TempDir()
+	mixedCase := filepath.Join(src, "github.com", "Sirupsen", "logrus")
+	lowerCase := filepath.Join(src, "github.com", "sirupsen", "logrus")
+	if err := os.MkdirAll(mixedCase, 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(lowerCase, 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(mixedCase, "go.mod"), []byte("module github.com/Sirupsen/logrus\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(lowerCase, "go.mod"), []byte("module github.com/sirupsen/logrus\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	safe, err := CaseSafeModuleCache(src)
+	if err != nil {
+		t.Fatalf("CaseSafeModuleCache: %v", err)
+	}
+	defer os.RemoveAll(safe)
+
+	linuxLayout := t.TempDir()
+	escapedMixed := filepath.Join(linuxLayout, "github.com", "!sirupsen", "logrus")
+	escapedLower := filepath.Join(linuxLayout, "github.com", "sirupsen", "logrus")
+	if err := os.MkdirAll(escapedMixed, 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(escapedLower, 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(escapedMixed, "go.mod"), []byte("module github.com/Sirupsen/logrus\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(escapedLower, "go.mod"), []byte("module github.com/sirupsen/logrus\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	gotHash, err := ComputeDirHash(safe)
+	if err != nil {
+		t.Fatalf("ComputeDirHash(safe): %v", err)
+	}
+	wantHash, err := ComputeDirHash(linuxLayout)
+	if err != nil {
+		t.Fatalf("ComputeDirHash(linuxLayout): %v", err)
+	}
+	if gotHash != wantHash {
+		t.Errorf("CaseSafeModuleCache hash = %s, want %s (the safe-encoded layout a Linux toolchain would already produce)", gotHash, wantHash)
+	}
+}